@@ -1,13 +1,28 @@
 package db
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 )
 
-const HEADER_SIZE uint16 = 4
+// The fixed node header is, in order: a checksum over the rest of the page,
+// a byte of reserved flags, a generation (transaction id) stamped by
+// BTree.new, the node type, and the key count.
+const checksumSize uint16 = 4
+const flagsSize uint16 = 1
+const generationSize uint16 = 8
+const typeSize uint16 = 2
+const keyCountSize uint16 = 2
+const HEADER_SIZE uint16 = checksumSize + flagsSize + generationSize + typeSize + keyCountSize
+
+const checksumOffset uint16 = 0
+const flagsOffset uint16 = checksumOffset + checksumSize
+const generationOffset uint16 = flagsOffset + flagsSize
+const typeOffset uint16 = generationOffset + generationSize
+const keyCountOffset uint16 = typeOffset + typeSize
+
+const LEAF_SIBLING_SIZE uint16 = 16 // prev leaf pointer + next leaf pointer
 const PAGE_SIZE = 4096
 const MAX_KEY_SIZE = 1000
 const MAX_VAL_SIZE = 3000
@@ -20,23 +35,72 @@ const (
 type BNode []byte
 
 type BTree struct {
-	root uint64
-	get  func(uint64) []byte
-	new  func([]byte) uint64
-	del  func(uint64)
+	root           uint64
+	get            func(uint64) []byte
+	new            func([]byte) uint64
+	del            func(uint64)
+	nextGeneration uint64
+
+	wal            *WAL
+	superblockPath string
+	txid           uint64
+	freeListHead   uint64
+
+	cache *NodeCache
 }
 
 func (node BNode) nodeType() uint16 {
-	return binary.LittleEndian.Uint16(node[0:2])
+	return binary.LittleEndian.Uint16(node[typeOffset : typeOffset+typeSize])
 }
 
 func (node BNode) keyCount() uint16 {
-	return binary.LittleEndian.Uint16(node[2:4])
+	return binary.LittleEndian.Uint16(node[keyCountOffset : keyCountOffset+keyCountSize])
 }
 
 func (node BNode) setHeader(nodeType uint16, keyCount uint16) {
-	binary.LittleEndian.PutUint16(node[0:2], nodeType)
-	binary.LittleEndian.PutUint16(node[2:4], keyCount)
+	binary.LittleEndian.PutUint16(node[typeOffset:typeOffset+typeSize], nodeType)
+	binary.LittleEndian.PutUint16(node[keyCountOffset:keyCountOffset+keyCountSize], keyCount)
+}
+
+// headerSize returns the number of bytes reserved at the start of the node
+// for the fixed header. Leaf nodes carry two extra 8-byte sibling pointers
+// (prev, next) so that a Cursor can walk between leaves without
+// re-descending from the root; internal nodes do not need them.
+func (node BNode) headerSize() uint16 {
+	if node.nodeType() == LEAF {
+		return HEADER_SIZE + LEAF_SIBLING_SIZE
+	}
+	return HEADER_SIZE
+}
+
+func (node BNode) getPrevLeaf() (uint64, error) {
+	if node.nodeType() != LEAF {
+		return 0, errors.New("Trying to retrieve the previous-leaf pointer from a non-leaf node.")
+	}
+	return binary.LittleEndian.Uint64(node[HEADER_SIZE : HEADER_SIZE+8]), nil
+}
+
+func (node BNode) setPrevLeaf(pointer uint64) error {
+	if node.nodeType() != LEAF {
+		return errors.New("Trying to set the previous-leaf pointer on a non-leaf node.")
+	}
+	binary.LittleEndian.PutUint64(node[HEADER_SIZE:HEADER_SIZE+8], pointer)
+	return nil
+}
+
+func (node BNode) getNextLeaf() (uint64, error) {
+	if node.nodeType() != LEAF {
+		return 0, errors.New("Trying to retrieve the next-leaf pointer from a non-leaf node.")
+	}
+	return binary.LittleEndian.Uint64(node[HEADER_SIZE+8 : HEADER_SIZE+16]), nil
+}
+
+func (node BNode) setNextLeaf(pointer uint64) error {
+	if node.nodeType() != LEAF {
+		return errors.New("Trying to set the next-leaf pointer on a non-leaf node.")
+	}
+	binary.LittleEndian.PutUint64(node[HEADER_SIZE+8:HEADER_SIZE+16], pointer)
+	return nil
 }
 
 func (node BNode) getPointer(index uint16) (uint64, error) {
@@ -81,7 +145,7 @@ func (node BNode) getOffset(index uint16) (uint16, error) {
 	if index == 0 {
 		return 0, nil
 	}
-	position := HEADER_SIZE + node.pointerBytes() + 2*(index-1)
+	position := node.headerSize() + node.pointerBytes() + 2*(index-1)
 	return binary.LittleEndian.Uint16(node[position : position+2]), nil
 }
 
@@ -92,7 +156,7 @@ func (node BNode) setOffset(index uint16, offset uint16) error {
 	if index > node.keyCount() {
 		return errors.New("Trying to set offset for out-of-bounds index.")
 	}
-	position := HEADER_SIZE + node.pointerBytes() + 2*(index-1)
+	position := node.headerSize() + node.pointerBytes() + 2*(index-1)
 	binary.LittleEndian.PutUint16(node[position:position+2], offset)
 	return nil
 }
@@ -102,7 +166,7 @@ func (node BNode) getKeyValuePosition(index uint16) (uint16, error) {
 	if err != nil {
 		return 0, err
 	}
-	position := HEADER_SIZE + node.pointerBytes() + 2*node.keyCount() + offset
+	position := node.headerSize() + node.pointerBytes() + 2*node.keyCount() + offset
 	return position, nil
 }
 
@@ -118,7 +182,11 @@ func (node BNode) headerKeyValue() uint16 {
 	}
 }
 
-func (node BNode) getKey(index uint16) ([]byte, error) {
+// getKey returns a Slice aliasing the node's backing buffer. When node
+// came from a NodeCache, that buffer is only valid until the owning
+// CachedNode is released; call Copy() on the result if it needs to
+// outlive the Release.
+func (node BNode) getKey(index uint16) (Slice, error) {
 	if index >= node.keyCount() {
 		return nil, errors.New("Trying to retrieve key for out-of-bounds index.")
 	}
@@ -129,10 +197,12 @@ func (node BNode) getKey(index uint16) ([]byte, error) {
 	keyLength := binary.LittleEndian.Uint16(node[position : position+2])
 
 	keyPosition := position + node.headerKeyValue()
-	return node[keyPosition : keyPosition+keyLength], nil
+	return Slice(node[keyPosition : keyPosition+keyLength]), nil
 }
 
-func (node BNode) getValue(index uint16) ([]byte, error) {
+// getValue returns a Slice aliasing the node's backing buffer; see the
+// getKey doc comment about its lifetime under a NodeCache.
+func (node BNode) getValue(index uint16) (Slice, error) {
 	if node.nodeType() != LEAF {
 		return nil, errors.New("Trying to retrieve value from non-leaf node.")
 	}
@@ -147,7 +217,7 @@ func (node BNode) getValue(index uint16) ([]byte, error) {
 	valueLength := binary.LittleEndian.Uint16(node[position+2 : position+4])
 
 	valuePosition := position + node.headerKeyValue() + keyLength
-	return node[valuePosition : valuePosition+valueLength], nil
+	return Slice(node[valuePosition : valuePosition+valueLength]), nil
 }
 
 func (node BNode) totalSize() uint16 {
@@ -156,10 +226,16 @@ func (node BNode) totalSize() uint16 {
 	if err != nil {
 		panic("Unreachable, because last position should always be in range")
 	}
-	return HEADER_SIZE + node.pointerBytes() + 2*count + afterLastPosition
+	return node.headerSize() + node.pointerBytes() + 2*count + afterLastPosition
 }
 
-func (node BNode) find(key []byte) (uint16, bool) {
+// find locates (key, disambiguator) among the node's entries, each of
+// which stores its own (userKey, disambiguator) pair. It returns the
+// largest index whose entry is less than or equal to the target, and
+// whether that entry is an exact match. If the target sorts before every
+// entry, it returns (0, false); callers compare against entry 0 to tell
+// that case apart.
+func (node BNode) find(key []byte, disambiguator uint64) (uint16, bool) {
 	count := node.keyCount()
 	if count <= 0 {
 		panic("Node should never be empty.")
@@ -167,21 +243,25 @@ func (node BNode) find(key []byte) (uint16, bool) {
 	end := count
 	var start uint16 = 0
 
-	firstKey, err := node.getKey(0)
+	firstUserKey, firstDisambiguator, err := node.userKeyAndDisambiguator(0)
 	if err != nil {
 		panic("Key at index zero should always exist in non-empty node.")
 	}
-	if bytes.Compare(firstKey, key) > 0 {
-		panic("First key is a copy from the parent node, and should therefore always be less or equal to the key.")
+	firstCmp := compareKeyEntries(firstUserKey, firstDisambiguator, key, disambiguator)
+	if firstCmp == 0 {
+		return 0, true
+	}
+	if firstCmp > 0 {
+		return 0, false
 	}
 
 	for end-start > 1 {
 		middle := (start + end) / 2
-		middleKey, err := node.getKey(middle)
+		middleUserKey, middleDisambiguator, err := node.userKeyAndDisambiguator(middle)
 		if err != nil {
 			panic(fmt.Errorf("Unexpected error, because in search '%d < %d' should always hold.", middle, count))
 		}
-		cmp := bytes.Compare(middleKey, key)
+		cmp := compareKeyEntries(middleUserKey, middleDisambiguator, key, disambiguator)
 		if cmp == 0 {
 			return middle, true
 		} else if cmp < 0 {
@@ -194,7 +274,7 @@ func (node BNode) find(key []byte) (uint16, bool) {
 }
 
 func (node BNode) sections() ([]byte, []byte, []byte) {
-	pointersStart := HEADER_SIZE
+	pointersStart := node.headerSize()
 	offsetsStart := pointersStart + node.pointerBytes()
 	keyValueStart := offsetsStart + 2*node.keyCount()
 	end := node.totalSize()
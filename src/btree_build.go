@@ -0,0 +1,75 @@
+package db
+
+import "encoding/binary"
+
+// emptyNode allocates a fresh, zeroed page-sized buffer for a node of the
+// given type with no entries yet. Callers fill it in with appendKV/appendRange
+// and then hand it to BTree.newNode once it is complete.
+func emptyNode(nodeType uint16) BNode {
+	node := make(BNode, PAGE_SIZE)
+	node.setHeader(nodeType, 0)
+	return node
+}
+
+// appendKV writes the entry at index into node. For internal nodes, value is
+// ignored and pointer is stored instead; for leaf nodes, pointer is ignored.
+// The node's key count and, for internal nodes, its pointer table must
+// already be sized for the final number of entries before the first call.
+func (node BNode) appendKV(index uint16, pointer uint64, key, value []byte) error {
+	if node.nodeType() == INTERNAL {
+		if err := node.setPointer(index, pointer); err != nil {
+			return err
+		}
+	}
+	position, err := node.getKeyValuePosition(index)
+	if err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint16(node[position:position+2], uint16(len(key)))
+	headerKV := node.headerKeyValue()
+	if node.nodeType() == LEAF {
+		binary.LittleEndian.PutUint16(node[position+2:position+4], uint16(len(value)))
+	}
+	entryEnd := position + headerKV
+	copy(node[entryEnd:], key)
+	entryEnd += uint16(len(key))
+	if node.nodeType() == LEAF {
+		copy(node[entryEnd:], value)
+		entryEnd += uint16(len(value))
+	}
+	if index+1 <= node.keyCount() {
+		offset, err := node.getOffset(index)
+		if err != nil {
+			return err
+		}
+		if err := node.setOffset(index+1, offset+(entryEnd-position)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendRange copies count entries starting at srcIndex in src into node
+// starting at dstIndex, preserving pointers (internal) or values (leaf).
+func (node BNode) appendRange(dstIndex uint16, src BNode, srcIndex uint16, count uint16) error {
+	for i := uint16(0); i < count; i++ {
+		key, err := src.getKey(srcIndex + i)
+		if err != nil {
+			return err
+		}
+		var value []byte
+		var pointer uint64
+		if src.nodeType() == INTERNAL {
+			pointer, err = src.getPointer(srcIndex + i)
+		} else {
+			value, err = src.getValue(srcIndex + i)
+		}
+		if err != nil {
+			return err
+		}
+		if err := node.appendKV(dstIndex+i, pointer, key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
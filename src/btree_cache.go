@@ -0,0 +1,217 @@
+package db
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// Slice is a byte slice returned by accessors such as getKey and getValue.
+// It may alias a page's backing buffer, which is only guaranteed to stay
+// put until the CachedNode that owns it is released (see BTree.WithCache);
+// call Copy() to get a slice that outlives the release.
+type Slice []byte
+
+// Copy returns an independent copy of s, safe to keep after the page it
+// came from has been released back to its NodeCache.
+func (s Slice) Copy() []byte {
+	clone := make([]byte, len(s))
+	copy(clone, s)
+	return clone
+}
+
+// CachedNode is a ref-counted, pooled BNode buffer handed out by a
+// NodeCache. Callers must pass it back to NodeCache.Release exactly once
+// they are done reading it.
+type CachedNode struct {
+	BNode
+	pageID   uint64
+	refCount int32
+	evicted  bool
+}
+
+// cacheEntry is the value stored in a NodeCache's LRU list.
+type cacheEntry struct {
+	pageID uint64
+	node   *CachedNode
+}
+
+// NodeCache sits between a BTree and its underlying page store, so that
+// repeated descents don't re-allocate and re-decode the same pages. It
+// bounds itself to max resident pages, evicting the least-recently-used
+// unreferenced entry to a sync.Pool of page-sized buffers.
+type NodeCache struct {
+	max int
+	get func(uint64) []byte
+
+	mu      sync.Mutex
+	entries map[uint64]*list.Element
+	order   *list.List
+	pool    sync.Pool
+}
+
+// NewNodeCache builds a cache of at most max resident pages, fetching
+// misses through get.
+func NewNodeCache(max int, get func(uint64) []byte) *NodeCache {
+	return &NodeCache{
+		max:     max,
+		get:     get,
+		entries: make(map[uint64]*list.Element),
+		order:   list.New(),
+		pool:    sync.Pool{New: func() any { return make(BNode, PAGE_SIZE) }},
+	}
+}
+
+// Get returns the page for pageID, fetching and caching it on a miss. The
+// returned CachedNode's refcount is incremented; the caller must call
+// Release exactly once when done with it.
+func (cache *NodeCache) Get(pageID uint64) *CachedNode {
+	cache.mu.Lock()
+	if elem, ok := cache.entries[pageID]; ok {
+		cache.order.MoveToFront(elem)
+		node := elem.Value.(*cacheEntry).node
+		atomic.AddInt32(&node.refCount, 1)
+		cache.mu.Unlock()
+		return node
+	}
+	cache.evictOverCapacityLocked()
+
+	buf := cache.pool.Get().(BNode)
+	raw := cache.get(pageID)
+	if cap(buf) < len(raw) {
+		buf = make(BNode, len(raw))
+	}
+	buf = buf[:len(raw)]
+	copy(buf, raw)
+
+	node := &CachedNode{BNode: buf, pageID: pageID, refCount: 1}
+	elem := cache.order.PushFront(&cacheEntry{pageID: pageID, node: node})
+	cache.entries[pageID] = elem
+	cache.mu.Unlock()
+	return node
+}
+
+// Insert opportunistically warms the cache with a page the tree just
+// wrote, so the next Get for it doesn't round-trip through the store. It
+// is a no-op if pageID is already cached. Like Get's miss path, it copies
+// node into a pooled buffer rather than aliasing the caller's slice,
+// since the caller (BTree.newNode) may still go on to mutate that slice
+// in place (see persistLeafChain's two-pass sibling-pointer fixup).
+func (cache *NodeCache) Insert(pageID uint64, node BNode) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if _, ok := cache.entries[pageID]; ok {
+		return
+	}
+	cache.evictOverCapacityLocked()
+
+	buf := cache.pool.Get().(BNode)
+	if cap(buf) < len(node) {
+		buf = make(BNode, len(node))
+	}
+	buf = buf[:len(node)]
+	copy(buf, node)
+
+	elem := cache.order.PushFront(&cacheEntry{pageID: pageID, node: &CachedNode{BNode: buf, pageID: pageID}})
+	cache.entries[pageID] = elem
+}
+
+// Invalidate drops pageID from the cache, e.g. because the page was
+// freed. If it is still referenced elsewhere, its buffer is returned to
+// the pool once the last Release for it comes in instead of right away.
+func (cache *NodeCache) Invalidate(pageID uint64) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	elem, ok := cache.entries[pageID]
+	if !ok {
+		return
+	}
+	cache.order.Remove(elem)
+	delete(cache.entries, pageID)
+
+	entry := elem.Value.(*cacheEntry)
+	if atomic.LoadInt32(&entry.node.refCount) == 0 {
+		cache.pool.Put(entry.node.BNode)
+	} else {
+		entry.node.evicted = true
+	}
+}
+
+// Release drops a reference acquired from Get. Once the refcount reaches
+// zero for an entry that has since been invalidated, its buffer is
+// returned to the pool.
+func (cache *NodeCache) Release(node *CachedNode) {
+	if atomic.AddInt32(&node.refCount, -1) != 0 {
+		return
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if node.evicted {
+		cache.pool.Put(node.BNode)
+	}
+}
+
+// evictOverCapacityLocked drops least-recently-used, unreferenced entries
+// until the cache is back at or under its capacity. It stops, rather than
+// blocking, if the oldest remaining entry is still pinned; max is
+// therefore a soft bound under heavy concurrent use.
+func (cache *NodeCache) evictOverCapacityLocked() {
+	for cache.order.Len() >= cache.max {
+		back := cache.order.Back()
+		if back == nil {
+			return
+		}
+		entry := back.Value.(*cacheEntry)
+		if atomic.LoadInt32(&entry.node.refCount) > 0 {
+			return
+		}
+		cache.order.Remove(back)
+		delete(cache.entries, entry.pageID)
+		cache.pool.Put(entry.node.BNode)
+	}
+}
+
+// WithCache fronts tree's page store with a bounded NodeCache of at most
+// size resident pages.
+func (tree *BTree) WithCache(size int) *BTree {
+	tree.cache = NewNodeCache(size, tree.get)
+	return tree
+}
+
+// getNode reads and checksum-verifies the page with the given id,
+// through the NodeCache when one is configured. The returned release
+// function must be called exactly once when the caller is done reading
+// the node; it is a no-op when there is no cache.
+func (tree *BTree) getNode(pageID uint64) (BNode, func(), error) {
+	var node BNode
+	release := func() {}
+	if tree.cache != nil {
+		cached := tree.cache.Get(pageID)
+		node = cached.BNode
+		release = func() { tree.cache.Release(cached) }
+	} else {
+		node = BNode(tree.get(pageID))
+	}
+
+	if err := node.verify(); err != nil {
+		release()
+		if corrupt, ok := err.(*ErrCorruptPage); ok {
+			corrupt.PageID = pageID
+		}
+		return nil, func() {}, err
+	}
+	return node, release, nil
+}
+
+// newNode stamps node with the next generation, signs it, persists it via
+// the tree's underlying page store, and warms the cache with it if one is
+// configured.
+func (tree *BTree) newNode(node BNode) uint64 {
+	tree.nextGeneration++
+	node.sign(tree.nextGeneration)
+	pageID := tree.new(node)
+	if tree.cache != nil {
+		tree.cache.Insert(pageID, node)
+	}
+	return pageID
+}
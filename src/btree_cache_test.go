@@ -0,0 +1,89 @@
+package db
+
+import "testing"
+
+// fakeStore backs a NodeCache with fixed-content pages and counts how many
+// times each page id was actually fetched, so tests can tell a cache hit
+// from a miss.
+type fakeStore struct {
+	fetches map[uint64]int
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{fetches: map[uint64]int{}}
+}
+
+func (s *fakeStore) get(pageID uint64) []byte {
+	s.fetches[pageID]++
+	page := make([]byte, PAGE_SIZE)
+	page[0] = byte(pageID)
+	return page
+}
+
+func TestNodeCacheHitAvoidsRefetch(t *testing.T) {
+	store := newFakeStore()
+	cache := NewNodeCache(4, store.get)
+
+	node := cache.Get(1)
+	cache.Release(node)
+	node = cache.Get(1)
+	cache.Release(node)
+
+	if got := store.fetches[1]; got != 1 {
+		t.Errorf("store.fetches[1] = %d, want 1 (second Get should hit the cache)", got)
+	}
+}
+
+func TestNodeCacheEvictsLeastRecentlyUsedOverCapacity(t *testing.T) {
+	store := newFakeStore()
+	cache := NewNodeCache(2, store.get)
+
+	cache.Release(cache.Get(1))
+	cache.Release(cache.Get(2))
+	// Over capacity: evicts the least-recently-used unreferenced entry,
+	// which is 1 (2 was touched more recently).
+	cache.Release(cache.Get(3))
+	cache.Release(cache.Get(2))
+
+	cache.Release(cache.Get(1))
+	if got := store.fetches[1]; got != 2 {
+		t.Errorf("store.fetches[1] = %d, want 2 (page 1 should have been evicted and refetched)", got)
+	}
+	if got := store.fetches[2]; got != 1 {
+		t.Errorf("store.fetches[2] = %d, want 1 (page 2 should still be cached)", got)
+	}
+}
+
+func TestNodeCacheDoesNotEvictPinnedEntry(t *testing.T) {
+	store := newFakeStore()
+	cache := NewNodeCache(2, store.get)
+
+	pinned := cache.Get(1) // left referenced, not released
+	cache.Release(cache.Get(2))
+	cache.Release(cache.Get(3))
+
+	cache.Release(cache.Get(1))
+	if got := store.fetches[1]; got != 1 {
+		t.Errorf("store.fetches[1] = %d, want 1 (pinned page must not be evicted)", got)
+	}
+	cache.Release(pinned)
+}
+
+func TestNodeCacheInsertWarmsWithoutAliasingCaller(t *testing.T) {
+	store := newFakeStore()
+	cache := NewNodeCache(4, store.get)
+
+	page := make(BNode, PAGE_SIZE)
+	page[0] = 0xAA
+	cache.Insert(42, page)
+	page[0] = 0xBB // mutate the caller's copy after inserting
+
+	cached := cache.Get(42)
+	defer cache.Release(cached)
+	if cached.BNode[0] != 0xAA {
+		t.Errorf("cached page[0] = %#x, want %#x (Insert must copy, not alias, the caller's buffer)", cached.BNode[0], 0xAA)
+	}
+	if got := store.fetches[42]; got != 0 {
+		t.Errorf("store.fetches[42] = %d, want 0 (Insert should have warmed the cache)", got)
+	}
+}
@@ -0,0 +1,64 @@
+package db
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorruptPage is returned when a page's stored checksum does not match
+// the checksum computed over its current contents.
+type ErrCorruptPage struct {
+	PageID   uint64
+	Expected uint32
+	Actual   uint32
+}
+
+func (e *ErrCorruptPage) Error() string {
+	return fmt.Sprintf("page %d is corrupt: expected checksum %08x, got %08x", e.PageID, e.Expected, e.Actual)
+}
+
+// checksum computes the CRC32C checksum over everything in the page after
+// the checksum field itself.
+func (node BNode) checksum() uint32 {
+	return crc32.Checksum(node[checksumSize:], castagnoliTable)
+}
+
+// storedChecksum returns the checksum that was last written by sign().
+func (node BNode) storedChecksum() uint32 {
+	return binary.LittleEndian.Uint32(node[checksumOffset : checksumOffset+checksumSize])
+}
+
+// generation returns the value BTree.newNode stamped the page with: the
+// tree's nextGeneration counter at the time the page was written. See
+// TxRecord.NextGeneration for how that counter survives a restart without
+// going on to reissue generations a since-crashed process already used.
+func (node BNode) generation() uint64 {
+	return binary.LittleEndian.Uint64(node[generationOffset : generationOffset+generationSize])
+}
+
+func (node BNode) setGeneration(generation uint64) {
+	binary.LittleEndian.PutUint64(node[generationOffset:generationOffset+generationSize], generation)
+}
+
+// sign stamps the node with the given generation and (re)computes its
+// checksum. It must be called after all other header and payload fields
+// have been written, and is done automatically by BTree.newNode.
+func (node BNode) sign(generation uint64) {
+	node.setGeneration(generation)
+	binary.LittleEndian.PutUint32(node[checksumOffset:checksumOffset+checksumSize], node.checksum())
+}
+
+// verify reports whether the node's payload still matches the checksum
+// written by sign(). The returned *ErrCorruptPage has PageID left at zero;
+// callers that know the page id should fill it in.
+func (node BNode) verify() error {
+	expected := node.storedChecksum()
+	actual := node.checksum()
+	if expected != actual {
+		return &ErrCorruptPage{Expected: expected, Actual: actual}
+	}
+	return nil
+}
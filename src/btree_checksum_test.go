@@ -0,0 +1,74 @@
+package db
+
+import (
+	"errors"
+	"testing"
+)
+
+// testStore is an in-memory stand-in for the on-disk page store, so tests
+// don't need a real file to back a BTree.
+type testStore struct {
+	pages  map[uint64][]byte
+	nextID uint64
+}
+
+// newTestTree builds a BTree over a fresh testStore, seeded with a single
+// empty leaf as its root - the same starting state a brand new on-disk
+// tree would have.
+func newTestTree(t *testing.T) (*BTree, *testStore) {
+	t.Helper()
+	store := &testStore{pages: map[uint64][]byte{}}
+	tree := &BTree{
+		get: func(id uint64) []byte { return store.pages[id] },
+		new: func(node []byte) uint64 {
+			store.nextID++
+			buf := make([]byte, len(node))
+			copy(buf, node)
+			store.pages[store.nextID] = buf
+			return store.nextID
+		},
+		del: func(id uint64) { delete(store.pages, id) },
+	}
+	tree.root = tree.newNode(emptyNode(LEAF))
+	return tree, store
+}
+
+func TestGetNodeAcceptsUntamperedPage(t *testing.T) {
+	tree, _ := newTestTree(t)
+	if err := tree.Insert([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+
+	node, release, err := tree.getNode(tree.root)
+	if err != nil {
+		t.Fatalf("getNode: %v", err)
+	}
+	defer release()
+	if node.keyCount() != 1 {
+		t.Errorf("keyCount() = %d, want 1", node.keyCount())
+	}
+}
+
+func TestGetNodeDetectsCorruptPage(t *testing.T) {
+	tree, store := newTestTree(t)
+	if err := tree.Insert([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+
+	page, ok := store.pages[tree.root]
+	if !ok {
+		t.Fatalf("root page %d not found in store", tree.root)
+	}
+	// Flip the reserved flags byte: it is inside the checksummed range but
+	// not otherwise interpreted, so this only trips verify().
+	page[flagsOffset] ^= 0xFF
+
+	_, _, err := tree.getNode(tree.root)
+	var corrupt *ErrCorruptPage
+	if !errors.As(err, &corrupt) {
+		t.Fatalf("getNode on a tampered page: got %v, want *ErrCorruptPage", err)
+	}
+	if corrupt.PageID != tree.root {
+		t.Errorf("ErrCorruptPage.PageID = %d, want %d", corrupt.PageID, tree.root)
+	}
+}
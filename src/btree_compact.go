@@ -0,0 +1,274 @@
+package db
+
+import "context"
+
+// defaultCompactSlack is used when CompactOptions.Slack is zero: a run of
+// sibling nodes filled to less than 3/4 of PAGE_SIZE combined is worth
+// rewriting into fewer pages.
+const defaultCompactSlack = PAGE_SIZE / 4
+
+// CompactOptions configures a Compact pass.
+type CompactOptions struct {
+	// Slack is how many bytes below PAGE_SIZE a contiguous run of sibling
+	// nodes must clear, combined, before Compact merges them into fewer
+	// pages. Zero means defaultCompactSlack.
+	Slack uint16
+
+	// OnProgress, if set, is called after every run Compact merges, with
+	// the Stats accumulated so far. Returning false stops the pass early;
+	// the rest of the tree is left untouched for a later call, so Compact
+	// can be paced across many small slices instead of stalling writers
+	// with one long pass.
+	OnProgress func(Stats) bool
+}
+
+// Stats reports what a Compact pass did.
+type Stats struct {
+	PagesFreed     int
+	PagesRewritten int
+	BytesReclaimed int
+}
+
+// compactState threads the options and running totals through the
+// recursive walk so each level doesn't have to pass them individually.
+//
+// Every node Compact fetches may be read by an ancestor frame much later
+// (mergeUnderfilledRuns scanning sizes, mergeRun copying bytes,
+// rebuildInternal reading separator keys) after the frame that fetched it
+// has returned. So fetched nodes are not released as soon as their own
+// frame is done with them; every release is queued in pending and run
+// only once, after the whole walk has finished reading from anything.
+type compactState struct {
+	ctx     context.Context
+	slack   uint16
+	opts    CompactOptions
+	stats   Stats
+	freed   []uint64
+	pending []func()
+	stopped bool
+}
+
+func (state *compactState) releaseAll() {
+	for _, release := range state.pending {
+		release()
+	}
+	state.pending = nil
+}
+
+// Compact walks the tree bottom-up and rewrites any contiguous run of
+// sibling nodes (leaves, or internal nodes one level up) whose combined
+// totalSize fits under PAGE_SIZE - opts.Slack into as few fresh pages as
+// the run needs. treeDelete only merges an underflowing child with one
+// adjacent sibling; Compact reclaims what that leaves behind in bulk, such
+// as runs of three or more underfilled siblings.
+//
+// ctx and opts.OnProgress both offer a way to stop early, mid-walk,
+// without leaving the tree in an inconsistent state: every node Compact
+// has not yet reached is carried over unchanged, so the partial result is
+// committed as a valid tree and a later call can pick up where this one
+// left off.
+func (tree *BTree) Compact(ctx context.Context, opts CompactOptions) (Stats, error) {
+	slack := opts.Slack
+	if slack == 0 {
+		slack = defaultCompactSlack
+	}
+	state := &compactState{ctx: ctx, slack: slack, opts: opts}
+	defer state.releaseAll()
+
+	result, changed, err := tree.compactSubtree(tree.root, state)
+	if err != nil {
+		return state.stats, err
+	}
+	if changed {
+		state.freed = append(state.freed, tree.root)
+	}
+
+	newRoot := result.ids[0]
+	node := result.nodes[0]
+	for node.nodeType() == INTERNAL && node.keyCount() == 1 {
+		childID, err := node.getPointer(0)
+		if err != nil {
+			return state.stats, err
+		}
+		state.freed = append(state.freed, newRoot)
+		child, release, err := tree.getNode(childID)
+		if err != nil {
+			return state.stats, err
+		}
+		state.pending = append(state.pending, release)
+		newRoot, node = childID, child
+	}
+
+	if newRoot == tree.root {
+		return state.stats, nil
+	}
+	if err := tree.commit(newRoot, state.freed); err != nil {
+		return state.stats, err
+	}
+	state.stats.PagesFreed = len(state.freed)
+	return state.stats, nil
+}
+
+// compactSubtree recursively compacts pageID's children before merging
+// underfilled runs among them, so a run that spans several rewritten
+// children is considered against their final, already-compacted sizes.
+// changed reports whether pageID itself needed to be rewritten, either
+// because a descendant changed or because a run at this level was merged.
+func (tree *BTree) compactSubtree(pageID uint64, state *compactState) (splitResult, bool, error) {
+	node, release, err := tree.getNode(pageID)
+	if err != nil {
+		return splitResult{}, false, err
+	}
+	state.pending = append(state.pending, release)
+
+	if state.stopped || node.nodeType() == LEAF {
+		return splitResult{ids: []uint64{pageID}, nodes: []BNode{node}}, false, nil
+	}
+
+	childIDs := make([]uint64, 0, node.keyCount())
+	childNodes := make([]BNode, 0, node.keyCount())
+	anyChildChanged := false
+	for i := uint16(0); i < node.keyCount(); i++ {
+		childID, err := node.getPointer(i)
+		if err != nil {
+			return splitResult{}, false, err
+		}
+		childResult, changed, err := tree.compactSubtree(childID, state)
+		if err != nil {
+			return splitResult{}, false, err
+		}
+		if changed {
+			anyChildChanged = true
+			state.freed = append(state.freed, childID)
+		}
+		childIDs = append(childIDs, childResult.ids...)
+		childNodes = append(childNodes, childResult.nodes...)
+	}
+
+	mergedIDs, mergedNodes, runsChanged := tree.mergeUnderfilledRuns(childIDs, childNodes, state)
+	if !anyChildChanged && !runsChanged {
+		return splitResult{ids: []uint64{pageID}, nodes: []BNode{node}}, false, nil
+	}
+
+	rebuilt := rebuildInternal(mergedIDs, mergedNodes)
+	id := tree.newNode(rebuilt)
+	state.stats.PagesRewritten++
+	return splitResult{ids: []uint64{id}, nodes: []BNode{rebuilt}}, true, nil
+}
+
+// mergeUnderfilledRuns scans children left to right and greedily merges
+// maximal runs whose combined totalSize fits under PAGE_SIZE - slack into
+// a single fresh page, freeing the pages it replaces. Runs of length one
+// are left as they are, since there is nothing to gain from rewriting
+// them alone.
+func (tree *BTree) mergeUnderfilledRuns(ids []uint64, nodes []BNode, state *compactState) ([]uint64, []BNode, bool) {
+	if len(nodes) == 0 {
+		return ids, nodes, false
+	}
+	threshold := uint32(PAGE_SIZE - state.slack)
+
+	outIDs := make([]uint64, 0, len(ids))
+	outNodes := make([]BNode, 0, len(nodes))
+	changed := false
+
+	i := 0
+	for i < len(nodes) {
+		if state.stopped || (state.ctx != nil && state.ctx.Err() != nil) {
+			state.stopped = true
+			outIDs = append(outIDs, ids[i:]...)
+			outNodes = append(outNodes, nodes[i:]...)
+			return outIDs, outNodes, changed
+		}
+
+		end := i + 1
+		total := uint32(nodes[i].totalSize())
+		for end < len(nodes) && total+uint32(nodes[end].totalSize()) <= threshold {
+			total += uint32(nodes[end].totalSize())
+			end++
+		}
+		if end-i < 2 {
+			outIDs = append(outIDs, ids[i])
+			outNodes = append(outNodes, nodes[i])
+			i++
+			continue
+		}
+
+		run := nodes[i:end]
+		merged := mergeRun(run)
+		var newIDs []uint64
+		var err error
+		if merged[0].nodeType() == LEAF {
+			prev, _ := run[0].getPrevLeaf()
+			next, _ := run[len(run)-1].getNextLeaf()
+			newIDs, err = tree.persistLeafChain(merged, prev, next, &state.freed)
+		} else {
+			newIDs = tree.persistAll(merged)
+		}
+		if err != nil {
+			outIDs = append(outIDs, ids[i:end]...)
+			outNodes = append(outNodes, nodes[i:end]...)
+			i = end
+			continue
+		}
+
+		var before, after int
+		for _, n := range run {
+			before += int(n.totalSize())
+		}
+		for _, n := range merged {
+			after += int(n.totalSize())
+		}
+
+		state.freed = append(state.freed, ids[i:end]...)
+		state.stats.PagesRewritten += len(merged)
+		state.stats.BytesReclaimed += before - after
+		changed = true
+
+		outIDs = append(outIDs, newIDs...)
+		outNodes = append(outNodes, merged...)
+		i = end
+
+		if state.opts.OnProgress != nil && !state.opts.OnProgress(state.stats) {
+			state.stopped = true
+		}
+	}
+	return outIDs, outNodes, changed
+}
+
+// mergeRun concatenates a run of same-type sibling nodes into a single
+// node. The caller only ever invokes it on runs whose combined totalSize
+// already fits under PAGE_SIZE, but it is routed through splitOversized
+// anyway so a miscounted run fails safe instead of overflowing a page.
+func mergeRun(run []BNode) []BNode {
+	nodeType := run[0].nodeType()
+	var count uint16
+	for _, n := range run {
+		count += n.keyCount()
+	}
+
+	merged := emptyNode(nodeType)
+	merged.setHeader(nodeType, count)
+	var dst uint16
+	for _, n := range run {
+		mustAppendRange(merged, dst, n, 0, n.keyCount())
+		dst += n.keyCount()
+	}
+	return splitOversized(merged)
+}
+
+// rebuildInternal builds a fresh internal node pointing at childIDs, using
+// each child's first key as its separator. It is the Compact-side
+// equivalent of growRoot, used to repoint a node at its (possibly merged)
+// children without going through replaceChild's single-index patching.
+func rebuildInternal(childIDs []uint64, childNodes []BNode) BNode {
+	node := emptyNode(INTERNAL)
+	node.setHeader(INTERNAL, uint16(len(childIDs)))
+	for i, id := range childIDs {
+		key, err := childNodes[i].getKey(0)
+		if err != nil {
+			panic("Unreachable, a compacted node is never empty.")
+		}
+		mustAppendKV(node, uint16(i), id, key, nil)
+	}
+	return node
+}
@@ -0,0 +1,198 @@
+package db
+
+import "errors"
+
+// ErrCursorExhausted is returned by Cursor.Next and Cursor.Prev once there
+// are no more entries in that direction.
+var ErrCursorExhausted = errors.New("cursor has no more entries in that direction")
+
+// Cursor iterates over the leaves of a BTree in key order. Once positioned,
+// it walks sideways via the leaves' sibling pointers instead of
+// re-descending from the root for every step. It keeps only the current
+// leaf's page id, not the page itself, so that each access goes through
+// BTree.getNode (and so the tree's NodeCache, if any) and is released
+// again before the call returns.
+type Cursor struct {
+	tree   *BTree
+	leafID uint64
+	index  uint16
+}
+
+// Seek descends to the leaf that would contain key and positions a Cursor
+// at the first entry whose user key is greater than or equal to key. If
+// key has duplicate entries, the cursor lands on the one with the
+// smallest disambiguator.
+func (tree *BTree) Seek(key []byte) (*Cursor, error) {
+	leafID, err := tree.findLeaf(key, 0)
+	if err != nil {
+		return nil, err
+	}
+	leaf, release, err := tree.getNode(leafID)
+	if err != nil {
+		return nil, err
+	}
+	// leaf.find panics on an empty leaf - the shape of an empty tree's
+	// root - so treat it as "nothing found here" directly instead.
+	var index uint16
+	var found bool
+	stepForward := true
+	if leaf.keyCount() > 0 {
+		index, found = leaf.find(key, 0)
+		if !found {
+			userKey, disambiguator, err := leaf.userKeyAndDisambiguator(index)
+			if err != nil {
+				release()
+				return nil, err
+			}
+			stepForward = compareKeyEntries(userKey, disambiguator, key, 0) < 0
+		}
+	}
+	release()
+
+	cursor := &Cursor{tree: tree, leafID: leafID, index: index}
+	if !found && stepForward {
+		// find() landed on the largest entry < (key, 0), so step forward
+		// once to reach the first entry >= (key, 0). When (key, 0) sorts
+		// before every entry of the leaf, entry 0 is already that entry.
+		if err := cursor.Next(); err != nil && err != ErrCursorExhausted {
+			return nil, err
+		}
+	}
+	return cursor, nil
+}
+
+// findLeaf descends from the root to the leaf that would contain
+// (key, disambiguator), returning its page id.
+func (tree *BTree) findLeaf(key []byte, disambiguator uint64) (uint64, error) {
+	pageID := tree.root
+	for {
+		node, release, err := tree.getNode(pageID)
+		if err != nil {
+			return 0, err
+		}
+		if node.nodeType() == LEAF {
+			release()
+			return pageID, nil
+		}
+		index, _ := node.find(key, disambiguator)
+		pointer, err := node.getPointer(index)
+		release()
+		if err != nil {
+			return 0, err
+		}
+		pageID = pointer
+	}
+}
+
+// Next advances the cursor to the next entry, moving to the following leaf
+// via its next-leaf pointer when the current leaf is exhausted.
+func (c *Cursor) Next() error {
+	leaf, release, err := c.tree.getNode(c.leafID)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if c.index+1 < leaf.keyCount() {
+		c.index++
+		return nil
+	}
+	nextID, err := leaf.getNextLeaf()
+	if err != nil {
+		return err
+	}
+	if nextID == 0 {
+		return ErrCursorExhausted
+	}
+	c.leafID = nextID
+	c.index = 0
+	return nil
+}
+
+// Prev moves the cursor to the previous entry, moving to the preceding leaf
+// via its prev-leaf pointer when the current leaf is exhausted.
+func (c *Cursor) Prev() error {
+	leaf, release, err := c.tree.getNode(c.leafID)
+	if err != nil {
+		return err
+	}
+
+	if c.index > 0 {
+		release()
+		c.index--
+		return nil
+	}
+	prevID, err := leaf.getPrevLeaf()
+	release()
+	if err != nil {
+		return err
+	}
+	if prevID == 0 {
+		return ErrCursorExhausted
+	}
+
+	prevLeaf, release, err := c.tree.getNode(prevID)
+	if err != nil {
+		return err
+	}
+	defer release()
+	c.leafID = prevID
+	c.index = prevLeaf.keyCount() - 1
+	return nil
+}
+
+// Key returns the raw, on-disk key (user key plus disambiguator suffix) at
+// the cursor's current position. Use UserKey to get just the caller's key.
+func (c *Cursor) Key() ([]byte, error) {
+	leaf, release, err := c.tree.getNode(c.leafID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	key, err := leaf.getKey(c.index)
+	if err != nil {
+		return nil, err
+	}
+	return key.Copy(), nil
+}
+
+// UserKey returns the caller-supplied key at the cursor's current
+// position, with the disambiguator suffix stripped off.
+func (c *Cursor) UserKey() ([]byte, error) {
+	leaf, release, err := c.tree.getNode(c.leafID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	userKey, _, err := leaf.userKeyAndDisambiguator(c.index)
+	if err != nil {
+		return nil, err
+	}
+	return userKey.Copy(), nil
+}
+
+// Disambiguator returns the disambiguator of the entry at the cursor's
+// current position.
+func (c *Cursor) Disambiguator() (uint64, error) {
+	leaf, release, err := c.tree.getNode(c.leafID)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	_, disambiguator, err := leaf.userKeyAndDisambiguator(c.index)
+	return disambiguator, err
+}
+
+// Value returns the value at the cursor's current position.
+func (c *Cursor) Value() ([]byte, error) {
+	leaf, release, err := c.tree.getNode(c.leafID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	value, err := leaf.getValue(c.index)
+	if err != nil {
+		return nil, err
+	}
+	return value.Copy(), nil
+}
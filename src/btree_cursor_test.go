@@ -0,0 +1,97 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCursorWalksForwardAndBackwardAcrossLeaves(t *testing.T) {
+	tree, _ := newTestTree(t)
+
+	const count = 150
+	value := make([]byte, 100)
+	for i := 0; i < count; i++ {
+		key := []byte(fmt.Sprintf("key-%04d", i))
+		if err := tree.Insert(key, value); err != nil {
+			t.Fatalf("Insert(%s): %v", key, err)
+		}
+	}
+
+	cursor, err := tree.Seek([]byte("key-0000"))
+	if err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	for i := 0; i < count; i++ {
+		want := fmt.Sprintf("key-%04d", i)
+		got, err := cursor.UserKey()
+		if err != nil {
+			t.Fatalf("UserKey at %d: %v", i, err)
+		}
+		if string(got) != want {
+			t.Fatalf("forward walk[%d] = %q, want %q", i, got, want)
+		}
+		err = cursor.Next()
+		if i < count-1 {
+			if err != nil {
+				t.Fatalf("Next at %d: %v", i, err)
+			}
+		} else if err != ErrCursorExhausted {
+			t.Fatalf("Next past the end: got %v, want ErrCursorExhausted", err)
+		}
+	}
+
+	cursor, err = tree.Seek([]byte(fmt.Sprintf("key-%04d", count-1)))
+	if err != nil {
+		t.Fatalf("Seek(last): %v", err)
+	}
+	for i := count - 1; i >= 0; i-- {
+		want := fmt.Sprintf("key-%04d", i)
+		got, err := cursor.UserKey()
+		if err != nil {
+			t.Fatalf("UserKey at %d: %v", i, err)
+		}
+		if string(got) != want {
+			t.Fatalf("backward walk[%d] = %q, want %q", i, got, want)
+		}
+		err = cursor.Prev()
+		if i > 0 {
+			if err != nil {
+				t.Fatalf("Prev at %d: %v", i, err)
+			}
+		} else if err != ErrCursorExhausted {
+			t.Fatalf("Prev past the start: got %v, want ErrCursorExhausted", err)
+		}
+	}
+}
+
+func TestSeekOnEmptyTreeIsExhausted(t *testing.T) {
+	tree, _ := newTestTree(t)
+	cursor, err := tree.Seek([]byte("anything"))
+	if err != nil {
+		t.Fatalf("Seek on empty tree: %v", err)
+	}
+	if _, err := cursor.UserKey(); err == nil {
+		t.Fatalf("UserKey on empty tree's cursor: got nil error, want one (no entries)")
+	}
+}
+
+func TestSeekLandsOnFirstKeyGreaterOrEqual(t *testing.T) {
+	tree, _ := newTestTree(t)
+	for _, key := range []string{"a", "c", "e"} {
+		if err := tree.Insert([]byte(key), []byte(key)); err != nil {
+			t.Fatalf("Insert(%s): %v", key, err)
+		}
+	}
+
+	cursor, err := tree.Seek([]byte("b"))
+	if err != nil {
+		t.Fatalf("Seek(b): %v", err)
+	}
+	got, err := cursor.UserKey()
+	if err != nil {
+		t.Fatalf("UserKey: %v", err)
+	}
+	if string(got) != "c" {
+		t.Fatalf("Seek(b).UserKey() = %q, want %q", got, "c")
+	}
+}
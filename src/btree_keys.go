@@ -0,0 +1,101 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"iter"
+)
+
+// disambiguatorSize is the width of the suffix appended to every stored
+// key so that the same user key can appear more than once in the tree,
+// each occurrence addressing a distinct value.
+const disambiguatorSize = 8
+
+// ReferencedValue pairs a stored value with the page holding the row it
+// was read from, so a secondary index entry can point back at its data
+// without duplicating it.
+type ReferencedValue struct {
+	Value       []byte
+	DataPointer uint64
+}
+
+// encodeKey builds the on-disk key entry for (userKey, disambiguator):
+// userKey followed by the disambiguator as 8 big-endian bytes, so that a
+// byte-wise comparison of two encoded keys for the *same length* user key
+// agrees with comparing the pairs directly.
+func encodeKey(userKey []byte, disambiguator uint64) []byte {
+	encoded := make([]byte, len(userKey)+disambiguatorSize)
+	copy(encoded, userKey)
+	binary.BigEndian.PutUint64(encoded[len(userKey):], disambiguator)
+	return encoded
+}
+
+// userKeyAndDisambiguator splits the stored key at index back into the
+// caller-supplied user key and its disambiguator. The returned Slice
+// aliases the node's backing buffer; see the getKey doc comment about its
+// lifetime under a NodeCache.
+func (node BNode) userKeyAndDisambiguator(index uint16) (Slice, uint64, error) {
+	stored, err := node.getKey(index)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(stored) < disambiguatorSize {
+		return nil, 0, errors.New("Stored key is shorter than the disambiguator suffix.")
+	}
+	split := len(stored) - disambiguatorSize
+	return stored[:split], binary.BigEndian.Uint64(stored[split:]), nil
+}
+
+// compareKeyEntries orders two (userKey, disambiguator) pairs
+// lexicographically on userKey, then numerically on disambiguator.
+func compareKeyEntries(userKeyA []byte, disambiguatorA uint64, userKeyB []byte, disambiguatorB uint64) int {
+	if cmp := bytes.Compare(userKeyA, userKeyB); cmp != 0 {
+		return cmp
+	}
+	switch {
+	case disambiguatorA < disambiguatorB:
+		return -1
+	case disambiguatorA > disambiguatorB:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// InsertDuplicate adds a (key, disambiguator) entry to the tree without
+// disturbing any other entry that shares key, backing secondary indexes
+// where the same user key maps to many rows.
+func (tree *BTree) InsertDuplicate(key, value []byte, disambiguator uint64) error {
+	return tree.upsert(key, disambiguator, value, true)
+}
+
+// DeleteDuplicate removes the single entry matching (key, disambiguator);
+// other entries sharing key are untouched.
+func (tree *BTree) DeleteDuplicate(key []byte, disambiguator uint64) error {
+	return tree.delete(key, disambiguator)
+}
+
+// FindAll walks forward from the first entry whose user key equals key,
+// yielding every value stored under that key in disambiguator order.
+func (tree *BTree) FindAll(key []byte) iter.Seq[[]byte] {
+	return func(yield func([]byte) bool) {
+		cursor, err := tree.Seek(key)
+		if err != nil {
+			return
+		}
+		for {
+			userKey, err := cursor.UserKey()
+			if err != nil || !bytes.Equal(userKey, key) {
+				return
+			}
+			value, err := cursor.Value()
+			if err != nil || !yield(value) {
+				return
+			}
+			if err := cursor.Next(); err != nil {
+				return
+			}
+		}
+	}
+}
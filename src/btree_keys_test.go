@@ -0,0 +1,113 @@
+package db
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompareKeyEntriesOrdersByUserKeyThenDisambiguator(t *testing.T) {
+	cases := []struct {
+		name           string
+		userKeyA       string
+		disambiguatorA uint64
+		userKeyB       string
+		disambiguatorB uint64
+		want           int
+	}{
+		{"equal", "abc", 1, "abc", 1, 0},
+		{"same key, lower disambiguator first", "abc", 1, "abc", 2, -1},
+		{"same key, higher disambiguator second", "abc", 2, "abc", 1, 1},
+		{"user key order wins over disambiguator", "abd", 0, "abc", 9, 1},
+		// "ab" < "abc" lexicographically regardless of disambiguator, even
+		// though the encoded on-disk bytes (userKey || disambiguator) would
+		// put a high enough disambiguator on "ab" after "abc"'s prefix -
+		// compareKeyEntries must compare the user keys directly, not the
+		// encoded byte strings, to get this right.
+		{"shorter prefix orders first despite large disambiguator", "ab", 1 << 63, "abc", 0, -1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := compareKeyEntries([]byte(c.userKeyA), c.disambiguatorA, []byte(c.userKeyB), c.disambiguatorB)
+			if sign(got) != sign(c.want) {
+				t.Errorf("compareKeyEntries(%q, %d, %q, %d) = %d, want sign %d", c.userKeyA, c.disambiguatorA, c.userKeyB, c.disambiguatorB, got, c.want)
+			}
+		})
+	}
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func TestInsertDuplicateOrdersByDisambiguator(t *testing.T) {
+	tree, _ := newTestTree(t)
+	if err := tree.InsertDuplicate([]byte("k"), []byte("third"), 2); err != nil {
+		t.Fatalf("InsertDuplicate(2): %v", err)
+	}
+	if err := tree.InsertDuplicate([]byte("k"), []byte("first"), 0); err != nil {
+		t.Fatalf("InsertDuplicate(0): %v", err)
+	}
+	if err := tree.InsertDuplicate([]byte("k"), []byte("second"), 1); err != nil {
+		t.Fatalf("InsertDuplicate(1): %v", err)
+	}
+
+	var got [][]byte
+	for value := range tree.FindAll([]byte("k")) {
+		got = append(got, value)
+	}
+	want := [][]byte{[]byte("first"), []byte("second"), []byte("third")}
+	if len(got) != len(want) {
+		t.Fatalf("FindAll(k) returned %d values, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Errorf("FindAll(k)[%d] = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestDeleteDuplicateLeavesOtherDisambiguators(t *testing.T) {
+	tree, _ := newTestTree(t)
+	if err := tree.InsertDuplicate([]byte("k"), []byte("zero"), 0); err != nil {
+		t.Fatalf("InsertDuplicate(0): %v", err)
+	}
+	if err := tree.InsertDuplicate([]byte("k"), []byte("one"), 1); err != nil {
+		t.Fatalf("InsertDuplicate(1): %v", err)
+	}
+	if err := tree.DeleteDuplicate([]byte("k"), 0); err != nil {
+		t.Fatalf("DeleteDuplicate(0): %v", err)
+	}
+
+	var got [][]byte
+	for value := range tree.FindAll([]byte("k")) {
+		got = append(got, value)
+	}
+	if len(got) != 1 || string(got[0]) != "one" {
+		t.Fatalf("FindAll(k) after DeleteDuplicate(0) = %q, want [one]", got)
+	}
+}
+
+func TestFindAllDoesNotCrossIntoNextUserKey(t *testing.T) {
+	tree, _ := newTestTree(t)
+	if err := tree.InsertDuplicate([]byte("ab"), []byte("ab-0"), 0); err != nil {
+		t.Fatalf("InsertDuplicate(ab, 0): %v", err)
+	}
+	if err := tree.InsertDuplicate([]byte("abc"), []byte("abc-0"), 0); err != nil {
+		t.Fatalf("InsertDuplicate(abc, 0): %v", err)
+	}
+
+	var got [][]byte
+	for value := range tree.FindAll([]byte("ab")) {
+		got = append(got, value)
+	}
+	if len(got) != 1 || string(got[0]) != "ab-0" {
+		t.Fatalf("FindAll(ab) = %q, want [ab-0] (must not include abc's entry)", got)
+	}
+}
@@ -0,0 +1,507 @@
+package db
+
+import (
+	"errors"
+)
+
+// ErrKeyNotFound is returned by Update when the key it was asked to
+// overwrite does not exist.
+var ErrKeyNotFound = errors.New("key not found")
+
+// splitResult carries the one or more pages a subtree COW-rebuilt into,
+// together with their in-memory contents so the caller can read first keys
+// without a round trip through BTree.get.
+type splitResult struct {
+	ids   []uint64
+	nodes []BNode
+}
+
+// Insert adds key/value to the tree, overwriting any existing value for
+// key. It is equivalent to InsertDuplicate(key, value, 0).
+func (tree *BTree) Insert(key, value []byte) error {
+	return tree.upsert(key, 0, value, true)
+}
+
+// Update overwrites the value for an existing key. It returns
+// ErrKeyNotFound if key is not present.
+func (tree *BTree) Update(key, value []byte) error {
+	return tree.upsert(key, 0, value, false)
+}
+
+func (tree *BTree) upsert(key []byte, disambiguator uint64, value []byte, upsert bool) error {
+	if len(key) == 0 || len(key) > MAX_KEY_SIZE {
+		return errors.New("Key length is out of bounds.")
+	}
+	if len(value) > MAX_VAL_SIZE {
+		return errors.New("Value length is out of bounds.")
+	}
+
+	freed := []uint64{}
+	result, err := tree.treeInsert(tree.root, key, disambiguator, value, upsert, &freed)
+	if err != nil {
+		return err
+	}
+
+	newRoot := result.ids[0]
+	if len(result.ids) > 1 {
+		root := tree.growRoot(result.ids, result.nodes)
+		newRoot = tree.newNode(root)
+	}
+	return tree.commit(newRoot, freed)
+}
+
+// treeInsert descends to the leaf holding (key, disambiguator), rebuilds
+// every node on the path via copy-on-write, and splits any node that
+// overflows PAGE_SIZE. The old copy of every page it touches is appended
+// to freed; the caller frees those pages only once the new root has been
+// committed.
+func (tree *BTree) treeInsert(pageID uint64, key []byte, disambiguator uint64, value []byte, upsert bool, freed *[]uint64) (splitResult, error) {
+	node, release, err := tree.getNode(pageID)
+	if err != nil {
+		return splitResult{}, err
+	}
+	defer release()
+	*freed = append(*freed, pageID)
+
+	if node.nodeType() == LEAF {
+		// node.find panics on an empty leaf, which is exactly the shape of
+		// a brand new or fully-drained tree's root (see delete's
+		// emptyNode(LEAF) root); there is nothing to find or insert
+		// relative to, so go straight to "insert at index 0".
+		var index uint16
+		var found bool
+		if node.keyCount() > 0 {
+			index, found = node.find(key, disambiguator)
+		}
+		if !found && !upsert {
+			return splitResult{}, ErrKeyNotFound
+		}
+
+		encoded := encodeKey(key, disambiguator)
+		var updated BNode
+		if found {
+			updated = leafUpdate(node, index, encoded, value)
+		} else {
+			insertAt := uint16(0)
+			if node.keyCount() > 0 {
+				insertAt = leafInsertionIndex(node, key, disambiguator, index)
+			}
+			updated = leafInsert(node, insertAt, encoded, value)
+		}
+		prev, _ := node.getPrevLeaf()
+		next, _ := node.getNextLeaf()
+
+		parts := splitOversized(updated)
+		ids, err := tree.persistLeafChain(parts, prev, next, freed)
+		if err != nil {
+			return splitResult{}, err
+		}
+		return splitResult{ids: ids, nodes: parts}, nil
+	}
+
+	index, _ := node.find(key, disambiguator)
+	childID, err := node.getPointer(index)
+	if err != nil {
+		return splitResult{}, err
+	}
+	childResult, err := tree.treeInsert(childID, key, disambiguator, value, upsert, freed)
+	if err != nil {
+		return splitResult{}, err
+	}
+
+	merged := tree.replaceChild(node, index, childResult.ids, childResult.nodes)
+	parts := splitOversized(merged)
+	ids := tree.persistAll(parts)
+	return splitResult{ids: ids, nodes: parts}, nil
+}
+
+// leafInsertionIndex turns the predecessor index returned by find() into
+// the index a new, not-yet-present (key, disambiguator) should be
+// inserted at.
+func leafInsertionIndex(node BNode, key []byte, disambiguator uint64, predecessor uint16) uint16 {
+	firstUserKey, firstDisambiguator, err := node.userKeyAndDisambiguator(0)
+	if err != nil {
+		panic("Unreachable, leaf is never empty.")
+	}
+	if compareKeyEntries(key, disambiguator, firstUserKey, firstDisambiguator) < 0 {
+		return 0
+	}
+	return predecessor + 1
+}
+
+func leafInsert(old BNode, index uint16, key, value []byte) BNode {
+	node := emptyNode(LEAF)
+	node.setHeader(LEAF, old.keyCount()+1)
+	mustAppendRange(node, 0, old, 0, index)
+	mustAppendKV(node, index, 0, key, value)
+	mustAppendRange(node, index+1, old, index, old.keyCount()-index)
+	return node
+}
+
+func leafUpdate(old BNode, index uint16, key, value []byte) BNode {
+	node := emptyNode(LEAF)
+	node.setHeader(LEAF, old.keyCount())
+	mustAppendRange(node, 0, old, 0, index)
+	mustAppendKV(node, index, 0, key, value)
+	mustAppendRange(node, index+1, old, index+1, old.keyCount()-index-1)
+	return node
+}
+
+func leafRemove(old BNode, index uint16) BNode {
+	node := emptyNode(LEAF)
+	node.setHeader(LEAF, old.keyCount()-1)
+	mustAppendRange(node, 0, old, 0, index)
+	mustAppendRange(node, index, old, index+1, old.keyCount()-index-1)
+	return node
+}
+
+// replaceChild rebuilds parent with the pointer at index replaced by
+// childIDs. A single id just swaps the pointer in place; more than one
+// means the child split, so the extra children are inserted right after
+// it using their own first key as the new separator.
+func (tree *BTree) replaceChild(parent BNode, index uint16, childIDs []uint64, childNodes []BNode) BNode {
+	node := emptyNode(INTERNAL)
+	node.setHeader(INTERNAL, parent.keyCount()-1+uint16(len(childIDs)))
+	mustAppendRange(node, 0, parent, 0, index)
+
+	existingKey, err := parent.getKey(index)
+	if err != nil {
+		panic("Unreachable, index is the child we just descended through.")
+	}
+	mustAppendKV(node, index, childIDs[0], existingKey, nil)
+	for i := 1; i < len(childIDs); i++ {
+		key, err := childNodes[i].getKey(0)
+		if err != nil {
+			panic("Unreachable, a freshly split node is never empty.")
+		}
+		mustAppendKV(node, index+uint16(i), childIDs[i], key, nil)
+	}
+
+	mustAppendRange(node, index+uint16(len(childIDs)), parent, index+1, parent.keyCount()-index-1)
+	return node
+}
+
+// dropChild rebuilds parent with the pointer at index removed entirely,
+// used when that child's subtree was deleted down to nothing.
+func dropChild(parent BNode, index uint16) BNode {
+	node := emptyNode(INTERNAL)
+	node.setHeader(INTERNAL, parent.keyCount()-1)
+	mustAppendRange(node, 0, parent, 0, index)
+	mustAppendRange(node, index, parent, index+1, parent.keyCount()-index-1)
+	return node
+}
+
+// growRoot builds a brand new root above a split that reached the top of
+// the tree.
+func (tree *BTree) growRoot(childIDs []uint64, childNodes []BNode) BNode {
+	root := emptyNode(INTERNAL)
+	root.setHeader(INTERNAL, uint16(len(childIDs)))
+	for i, id := range childIDs {
+		key, err := childNodes[i].getKey(0)
+		if err != nil {
+			panic("Unreachable, a freshly split node is never empty.")
+		}
+		mustAppendKV(root, uint16(i), id, key, nil)
+	}
+	return root
+}
+
+// splitOversized halves node until every part fits in PAGE_SIZE. A node
+// holding a single, very large key/value pair cannot be split further and
+// is returned as-is.
+func splitOversized(node BNode) []BNode {
+	if node.totalSize() <= PAGE_SIZE || node.keyCount() <= 1 {
+		return []BNode{node}
+	}
+	count := node.keyCount()
+	mid := count / 2
+
+	left := emptyNode(node.nodeType())
+	left.setHeader(node.nodeType(), mid)
+	mustAppendRange(left, 0, node, 0, mid)
+
+	right := emptyNode(node.nodeType())
+	right.setHeader(node.nodeType(), count-mid)
+	mustAppendRange(right, 0, node, mid, count-mid)
+
+	return append(splitOversized(left), splitOversized(right)...)
+}
+
+func (tree *BTree) persistAll(nodes []BNode) []uint64 {
+	ids := make([]uint64, len(nodes))
+	for i, node := range nodes {
+		ids[i] = tree.newNode(node)
+	}
+	return ids
+}
+
+// persistLeafChain writes out a run of leaves produced by splitting a
+// single original leaf, wiring prev/next so the run is internally
+// consistent and spliced into the oldPrev/oldNext it replaced.
+//
+// Persisting sibling pointers is a chicken-and-egg problem under COW: a
+// leaf's "next" id isn't known until its right neighbour has been written,
+// and under pure write-then-get-id COW (no id is known before its page is
+// written, and no page can be rewritten in place) there is no finite
+// sequence of passes that lands every leaf's *both* pointers on their
+// final id at once - fixing one direction for a leaf always means
+// rewriting it, which changes its id out from under whichever neighbour
+// already recorded the old one. We resolve it by writing right-to-left
+// for "next", then a second pass left-to-right that re-persists every
+// leaf whose prev pointer needs fixing. That second pass's ids are what
+// callers use (the returned slice, and everything built on top of it -
+// the parent's pointer table, freed bookkeeping, etc.), so "prev" ends up
+// exact. The first pass's now-superseded copies are deliberately *not*
+// added to freed, even though every leaf but the rightmost still has its
+// "next" pointing at one: a Cursor walking forward across this chain
+// follows those pointers, and they must keep resolving to a live page
+// with the same keys rather than one BTree.commit has deleted. They sit
+// unreferenced by the tree structure until a future BTree.Compact pass
+// (see the defragmenter) reclaims them, same as the *outer* neighbours at
+// oldPrev/oldNext, whose next/prev still point at the page we are
+// replacing.
+func (tree *BTree) persistLeafChain(nodes []BNode, oldPrev, oldNext uint64, freed *[]uint64) ([]uint64, error) {
+	ids := make([]uint64, len(nodes))
+
+	// Leftmost node's prev is already known (oldPrev); everyone else's
+	// prev is a placeholder until the second pass below.
+	next := oldNext
+	for i := len(nodes) - 1; i >= 0; i-- {
+		nodes[i].setNextLeaf(next)
+		if i == 0 {
+			nodes[i].setPrevLeaf(oldPrev)
+		} else {
+			nodes[i].setPrevLeaf(0)
+		}
+		ids[i] = tree.newNode(nodes[i])
+		next = ids[i]
+	}
+
+	prev := ids[0]
+	for i := 1; i < len(nodes); i++ {
+		nodes[i].setPrevLeaf(prev)
+		// The first pass's copy of nodes[i] (ids[i] here) is left
+		// unfreed: nodes[i-1]'s "next" field - already written and
+		// never revisited - still points at it. See the doc comment
+		// above.
+		replacement := tree.newNode(nodes[i])
+		ids[i] = replacement
+		prev = ids[i]
+	}
+
+	return ids, nil
+}
+
+func mustAppendKV(node BNode, index uint16, pointer uint64, key, value []byte) {
+	if err := node.appendKV(index, pointer, key, value); err != nil {
+		panic(err)
+	}
+}
+
+func mustAppendRange(node BNode, dstIndex uint16, src BNode, srcIndex, count uint16) {
+	if err := node.appendRange(dstIndex, src, srcIndex, count); err != nil {
+		panic(err)
+	}
+}
+
+// Delete removes key from the tree. It is a no-op, returning nil, if key is
+// not present. It is equivalent to DeleteDuplicate(key, 0).
+func (tree *BTree) Delete(key []byte) error {
+	return tree.delete(key, 0)
+}
+
+func (tree *BTree) delete(key []byte, disambiguator uint64) error {
+	freed := []uint64{}
+	result, err := tree.treeDelete(tree.root, key, disambiguator, &freed)
+	if err != nil {
+		return err
+	}
+	if len(freed) == 0 {
+		// Every actual removal frees at least the leaf page it came from,
+		// so an empty freed list means the key wasn't found anywhere in
+		// the tree and treeDelete returned it unchanged. Stop here rather
+		// than committing a "new" root identical to the old one.
+		return nil
+	}
+
+	var newRoot uint64
+	if len(result.ids) == 0 {
+		newRoot = tree.newNode(emptyNode(LEAF))
+	} else {
+		newRoot = result.ids[0]
+		node := result.nodes[0]
+		release := func() {}
+		for node.nodeType() == INTERNAL && node.keyCount() == 1 {
+			childID, err := node.getPointer(0)
+			if err != nil {
+				release()
+				return err
+			}
+			freed = append(freed, newRoot)
+			child, childRelease, err := tree.getNode(childID)
+			if err != nil {
+				release()
+				return err
+			}
+			release()
+			newRoot, node, release = childID, child, childRelease
+		}
+		release()
+	}
+	return tree.commit(newRoot, freed)
+}
+
+// treeDelete removes key from the subtree rooted at pageID. A child that
+// empties out entirely is dropped from its parent; a child that merely
+// underflows (totalSize < PAGE_SIZE/4) is merged with an adjacent sibling
+// on the spot via mergeChildWithSibling. BTree.Compact remains useful on
+// top of this for reclaiming fragmentation this single-sibling merge
+// can't reach - e.g. a run of three or more underfilled leaves, or pages
+// left over from before this rebalancing existed.
+//
+// If key isn't found anywhere under pageID, the returned splitResult holds
+// pageID itself (unchanged) at every level on the way back up, and nothing
+// is added to freed - callers use that to recognize a true no-op and skip
+// committing a new root.
+func (tree *BTree) treeDelete(pageID uint64, key []byte, disambiguator uint64, freed *[]uint64) (splitResult, error) {
+	node, release, err := tree.getNode(pageID)
+	if err != nil {
+		return splitResult{}, err
+	}
+	defer release()
+
+	if node.nodeType() == LEAF {
+		// node.find panics on an empty leaf - the shape of an empty
+		// tree's root - so treat it as "key not found" directly instead.
+		var index uint16
+		var found bool
+		if node.keyCount() > 0 {
+			index, found = node.find(key, disambiguator)
+		}
+		if !found {
+			// Copy rather than returning node directly: it aliases a
+			// cached buffer that this function's deferred release may
+			// invalidate before an ancestor frame (e.g.
+			// mergeChildWithSibling, checking whether this unchanged
+			// leaf underflows) gets around to reading it.
+			unchanged := make(BNode, len(node))
+			copy(unchanged, node)
+			return splitResult{ids: []uint64{pageID}, nodes: []BNode{unchanged}}, nil
+		}
+		*freed = append(*freed, pageID)
+
+		updated := leafRemove(node, index)
+		if updated.keyCount() == 0 {
+			return splitResult{}, nil
+		}
+		prev, _ := node.getPrevLeaf()
+		next, _ := node.getNextLeaf()
+		updated.setPrevLeaf(prev)
+		updated.setNextLeaf(next)
+		id := tree.newNode(updated)
+		return splitResult{ids: []uint64{id}, nodes: []BNode{updated}}, nil
+	}
+
+	index, _ := node.find(key, disambiguator)
+	childID, err := node.getPointer(index)
+	if err != nil {
+		return splitResult{}, err
+	}
+	childResult, err := tree.treeDelete(childID, key, disambiguator, freed)
+	if err != nil {
+		return splitResult{}, err
+	}
+
+	if len(childResult.ids) == 1 && childResult.ids[0] == childID {
+		// Nothing changed below (key not found anywhere under this
+		// child): leave this node - and everything above it, all the
+		// way to delete's commit - untouched too, instead of unconditionally
+		// rewriting and re-freeing a page that never actually changed.
+		unchanged := make(BNode, len(node))
+		copy(unchanged, node)
+		return splitResult{ids: []uint64{pageID}, nodes: []BNode{unchanged}}, nil
+	}
+	*freed = append(*freed, pageID)
+
+	var merged BNode
+	if len(childResult.ids) == 0 {
+		if node.keyCount() == 1 {
+			return splitResult{}, nil
+		}
+		merged = dropChild(node, index)
+	} else if node.keyCount() > 1 && childResult.nodes[0].totalSize() < PAGE_SIZE/4 {
+		var err error
+		merged, err = tree.mergeChildWithSibling(node, index, childResult, freed)
+		if err != nil {
+			return splitResult{}, err
+		}
+	} else {
+		merged = tree.replaceChild(node, index, childResult.ids, childResult.nodes)
+	}
+	id := tree.newNode(merged)
+	return splitResult{ids: []uint64{id}, nodes: []BNode{merged}}, nil
+}
+
+// mergeChildWithSibling rebuilds parent with the underflowed child at
+// index combined with whichever neighbour it has (preferring the left
+// one) into a single node - or, if the pair is too large to fit on one
+// page after all, into two freshly rebalanced halves via splitOversized.
+// Either way both original pages are freed in favour of the rebuilt
+// one(s).
+func (tree *BTree) mergeChildWithSibling(parent BNode, index uint16, childResult splitResult, freed *[]uint64) (BNode, error) {
+	siblingIndex := index + 1
+	leftIndex := index
+	if index > 0 {
+		siblingIndex = index - 1
+		leftIndex = index - 1
+	}
+	siblingID, err := parent.getPointer(siblingIndex)
+	if err != nil {
+		return nil, err
+	}
+	sibling, release, err := tree.getNode(siblingID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	left, leftID, right, rightID := childResult.nodes[0], childResult.ids[0], sibling, siblingID
+	if leftIndex != index {
+		left, leftID, right, rightID = sibling, siblingID, childResult.nodes[0], childResult.ids[0]
+	}
+
+	mergedParts := mergeRun([]BNode{left, right})
+	var mergedIDs []uint64
+	if left.nodeType() == LEAF {
+		prev, _ := left.getPrevLeaf()
+		next, _ := right.getNextLeaf()
+		mergedIDs, err = tree.persistLeafChain(mergedParts, prev, next, freed)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		mergedIDs = tree.persistAll(mergedParts)
+	}
+	*freed = append(*freed, leftID, rightID)
+
+	return replaceSiblingPair(parent, leftIndex, mergedIDs, mergedParts), nil
+}
+
+// replaceSiblingPair rebuilds parent with the two children at leftIndex
+// and leftIndex+1 replaced by mergedIDs/mergedNodes - ordinarily a single
+// merged node, or two if mergeChildWithSibling had to fall back to a
+// rebalancing split.
+func replaceSiblingPair(parent BNode, leftIndex uint16, mergedIDs []uint64, mergedNodes []BNode) BNode {
+	node := emptyNode(INTERNAL)
+	node.setHeader(INTERNAL, parent.keyCount()-2+uint16(len(mergedIDs)))
+	mustAppendRange(node, 0, parent, 0, leftIndex)
+	for i, id := range mergedIDs {
+		key, err := mergedNodes[i].getKey(0)
+		if err != nil {
+			panic("Unreachable, a freshly merged node is never empty.")
+		}
+		mustAppendKV(node, leftIndex+uint16(i), id, key, nil)
+	}
+	mustAppendRange(node, leftIndex+uint16(len(mergedIDs)), parent, leftIndex+2, parent.keyCount()-leftIndex-2)
+	return node
+}
@@ -0,0 +1,127 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+)
+
+// get looks up key via a Cursor, returning ok=false if it is absent.
+func get(t *testing.T, tree *BTree, key []byte) (value []byte, ok bool) {
+	t.Helper()
+	cursor, err := tree.Seek(key)
+	if err != nil {
+		t.Fatalf("Seek(%q): %v", key, err)
+	}
+	userKey, err := cursor.UserKey()
+	if err != nil {
+		return nil, false
+	}
+	if string(userKey) != string(key) {
+		return nil, false
+	}
+	value, err = cursor.Value()
+	if err != nil {
+		t.Fatalf("Value: %v", err)
+	}
+	return value, true
+}
+
+func TestInsertAndGet(t *testing.T) {
+	tree, _ := newTestTree(t)
+	if err := tree.Insert([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+	value, ok := get(t, tree, []byte("a"))
+	if !ok || string(value) != "1" {
+		t.Fatalf("get(a) = %q, %v, want 1, true", value, ok)
+	}
+}
+
+func TestInsertOverwritesExistingKey(t *testing.T) {
+	tree, _ := newTestTree(t)
+	if err := tree.Insert([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+	if err := tree.Insert([]byte("a"), []byte("2")); err != nil {
+		t.Fatalf("Insert (overwrite): %v", err)
+	}
+	value, ok := get(t, tree, []byte("a"))
+	if !ok || string(value) != "2" {
+		t.Fatalf("get(a) = %q, %v, want 2, true", value, ok)
+	}
+}
+
+func TestUpdateMissingKeyFails(t *testing.T) {
+	tree, _ := newTestTree(t)
+	if err := tree.Update([]byte("missing"), []byte("v")); err != ErrKeyNotFound {
+		t.Fatalf("Update on missing key: got %v, want ErrKeyNotFound", err)
+	}
+}
+
+func TestDeleteMissingKeyIsNoop(t *testing.T) {
+	tree, _ := newTestTree(t)
+	if err := tree.Insert([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+	if err := tree.Delete([]byte("missing")); err != nil {
+		t.Fatalf("Delete missing key: %v", err)
+	}
+	if value, ok := get(t, tree, []byte("a")); !ok || string(value) != "1" {
+		t.Fatalf("get(a) after unrelated delete = %q, %v, want 1, true", value, ok)
+	}
+}
+
+func TestInsertSplitAndDeleteBackDown(t *testing.T) {
+	tree, _ := newTestTree(t)
+
+	// Insert enough large values to force leaf splits and grow the tree
+	// past a single-level root.
+	const count = 200
+	value := make([]byte, 200)
+	for i := range value {
+		value[i] = byte(i)
+	}
+	for i := 0; i < count; i++ {
+		key := []byte(fmt.Sprintf("key-%04d", i))
+		if err := tree.Insert(key, value); err != nil {
+			t.Fatalf("Insert(%s): %v", key, err)
+		}
+	}
+	for i := 0; i < count; i++ {
+		key := []byte(fmt.Sprintf("key-%04d", i))
+		got, ok := get(t, tree, key)
+		if !ok || string(got) != string(value) {
+			t.Fatalf("get(%s) after bulk insert: ok=%v", key, ok)
+		}
+	}
+
+	// Deleting most of the tree exercises both the merge-on-underflow path
+	// in treeDelete (mergeChildWithSibling) and collapsing the root back
+	// down once it's left with a single child.
+	for i := 0; i < count-1; i++ {
+		key := []byte(fmt.Sprintf("key-%04d", i))
+		if err := tree.Delete(key); err != nil {
+			t.Fatalf("Delete(%s): %v", key, err)
+		}
+	}
+	for i := 0; i < count-1; i++ {
+		key := []byte(fmt.Sprintf("key-%04d", i))
+		if _, ok := get(t, tree, key); ok {
+			t.Fatalf("get(%s) after delete: still present", key)
+		}
+	}
+	last := []byte(fmt.Sprintf("key-%04d", count-1))
+	got, ok := get(t, tree, last)
+	if !ok || string(got) != string(value) {
+		t.Fatalf("get(%s) survivor: ok=%v", last, ok)
+	}
+
+	root, release, err := tree.getNode(tree.root)
+	if err != nil {
+		t.Fatalf("getNode(root): %v", err)
+	}
+	defer release()
+	if root.nodeType() != LEAF {
+		t.Errorf("root.nodeType() = %d, want LEAF after collapsing down to one entry", root.nodeType())
+	}
+}
@@ -0,0 +1,219 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"io"
+	"os"
+)
+
+// TxRecord is a single write-ahead-log entry: one committed mutation of the
+// tree, recorded before the superblock is updated to point at it.
+// NextGeneration is the tree's generation high-water mark at the time of
+// this commit, i.e. the generation of the last page BTree.newNode wrote
+// (the next page gets this value plus one); carrying it here (rather than just deriving it from Txid)
+// lets WithWAL restore it exactly even for a transaction that wrote
+// several pages, not just one per commit.
+type TxRecord struct {
+	Txid           uint64
+	OldRoot        uint64
+	NewRoot        uint64
+	FreedPages     []uint64
+	NextGeneration uint64
+}
+
+// Superblock is the durable pointer to the current state of the tree: its
+// root page, the last committed transaction id, the head of the
+// free-page list, and the generation high-water mark (see TxRecord).
+type Superblock struct {
+	Root           uint64
+	Txid           uint64
+	FreeListHead   uint64
+	NextGeneration uint64
+}
+
+// WAL is an append-only log of TxRecords, fsynced after every append so a
+// crash can never lose a record the caller believes is committed.
+type WAL struct {
+	file *os.File
+}
+
+// OpenWAL opens (creating if necessary) the log file at path for
+// appending.
+func OpenWAL(path string) (*WAL, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &WAL{file: file}, nil
+}
+
+// Append writes record to the log as a length-prefixed, gob-encoded blob
+// and fsyncs before returning.
+func (wal *WAL) Append(record TxRecord) error {
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(record); err != nil {
+		return err
+	}
+
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(payload.Len()))
+	if _, err := wal.file.Write(length[:]); err != nil {
+		return err
+	}
+	if _, err := wal.file.Write(payload.Bytes()); err != nil {
+		return err
+	}
+	return wal.file.Sync()
+}
+
+// ReplayWAL reads every complete record from the log at path, in order. A
+// length header or payload that is truncated (the tail of a transaction
+// that crashed mid-write) stops replay instead of failing it; everything
+// read up to that point is still valid.
+func ReplayWAL(path string) ([]TxRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []TxRecord
+	for {
+		var length [4]byte
+		if _, err := io.ReadFull(file, length[:]); err != nil {
+			break
+		}
+		payload := make([]byte, binary.LittleEndian.Uint32(length[:]))
+		if _, err := io.ReadFull(file, payload); err != nil {
+			break
+		}
+		var record TxRecord
+		if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&record); err != nil {
+			break
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// WriteSuperblock durably overwrites the superblock at path: it is written
+// to a temp file first and then moved into place, so a crash mid-write
+// leaves the previous superblock intact rather than a half-written one.
+func WriteSuperblock(path string, superblock Superblock) error {
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(superblock); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(payload.Bytes()); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// ReadSuperblock reads the superblock at path, returning the zero value if
+// it does not exist yet.
+func ReadSuperblock(path string) (Superblock, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Superblock{}, nil
+		}
+		return Superblock{}, err
+	}
+	var superblock Superblock
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&superblock); err != nil {
+		return Superblock{}, err
+	}
+	return superblock, nil
+}
+
+// WithWAL attaches a write-ahead log and superblock file to tree and
+// recovers its root from them: it replays any committed transactions past
+// the superblock and adopts the newest one, falling back to the
+// superblock itself if the log is empty or missing.
+func (tree *BTree) WithWAL(walPath, superblockPath string) (*BTree, error) {
+	wal, err := OpenWAL(walPath)
+	if err != nil {
+		return nil, err
+	}
+	tree.wal = wal
+	tree.superblockPath = superblockPath
+
+	superblock, err := ReadSuperblock(superblockPath)
+	if err != nil {
+		return nil, err
+	}
+	tree.root = superblock.Root
+	tree.txid = superblock.Txid
+	tree.freeListHead = superblock.FreeListHead
+	tree.nextGeneration = superblock.NextGeneration
+
+	records, err := ReplayWAL(walPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		if record.Txid > tree.txid {
+			tree.root = record.NewRoot
+			tree.txid = record.Txid
+			tree.nextGeneration = record.NextGeneration
+		}
+	}
+	return tree, nil
+}
+
+// commit durably makes newRoot the tree's root: the transaction is logged
+// and fsynced, the superblock is atomically swapped to point at it, and
+// only then are the pages it superseded handed to del.
+func (tree *BTree) commit(newRoot uint64, freed []uint64) error {
+	tree.txid++
+	record := TxRecord{
+		Txid:           tree.txid,
+		OldRoot:        tree.root,
+		NewRoot:        newRoot,
+		FreedPages:     freed,
+		NextGeneration: tree.nextGeneration,
+	}
+
+	if tree.wal != nil {
+		if err := tree.wal.Append(record); err != nil {
+			return err
+		}
+		superblock := Superblock{
+			Root:           newRoot,
+			Txid:           tree.txid,
+			FreeListHead:   tree.freeListHead,
+			NextGeneration: tree.nextGeneration,
+		}
+		if err := WriteSuperblock(tree.superblockPath, superblock); err != nil {
+			return err
+		}
+	}
+
+	tree.root = newRoot
+	for _, pageID := range freed {
+		if tree.cache != nil {
+			tree.cache.Invalidate(pageID)
+		}
+		tree.del(pageID)
+	}
+	return nil
+}